@@ -7,10 +7,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
@@ -28,17 +32,41 @@ var ExitCode = 0
 
 // Params are the user-specified command-line arguments
 type Params struct {
-	Procs       int      `arg:"-p,help:number of processes to use."`
-	Nlines      int      `arg:"-n,help:number of lines to consume for each command. -s and -n are mutually exclusive."`
-	Retry       int      `arg:"-r,help:number of times to retry a command if it fails (default is 0)."`
-	Ordered     bool     `arg:"-o,help:keep output in order of input."`
-	Sep         string   `arg:"-s,help:regular expression split line with to fill multiple template spots default is not to split. -s and -n are mutually exclusive."`
-	Verbose     bool     `arg:"-v,help:print commands to stderr as they are executed."`
-	StopOnError bool     `arg:"-s,--stop-on-error,help:stop execution on any error. default is to report errors and continue execution."`
-	DryRun      bool     `arg:"-d,--dry-run,help:print (but do not run) the commands."`
-	Log         string   `arg:"-l,--log,help:file to log commands. Successful commands are prefixed with '#'."`
-	Command     string   `arg:"positional,required,help:command to execute."`
-	log         *os.File `arg:"-"`
+	Procs       int           `arg:"-p,help:number of processes to use."`
+	Nlines      int           `arg:"-n,help:number of lines to consume for each command. -s and -n are mutually exclusive."`
+	Retry       int           `arg:"-r,help:number of times to retry a command if it fails (default is 0)."`
+	Ordered     bool          `arg:"-o,help:keep output in order of input."`
+	Sep         string        `arg:"-s,help:regular expression split line with to fill multiple template spots default is not to split. -s and -n are mutually exclusive."`
+	Verbose     bool          `arg:"-v,help:print commands to stderr as they are executed."`
+	StopOnError bool          `arg:"-s,--stop-on-error,help:stop execution on any error. default is to report errors and continue execution."`
+	DryRun      bool          `arg:"-d,--dry-run,help:print (but do not run) the commands."`
+	Log         string        `arg:"-l,--log,help:file to log commands. Successful commands are prefixed with '#'."`
+	Stderr      string        `arg:"--stderr,help:how to handle each command's stderr: capture|merge|inherit|discard (default inherit)."`
+	StderrLog   string        `arg:"--stderr-log,help:file to write captured stderr to when --stderr=capture (default stderr.log next to --log, or if no --log the same stream as command output: stdout, or stderr with --results -)."`
+	Timeout     time.Duration `arg:"-t,--timeout,help:kill a command if it runs longer than this (e.g. 30s, 5m). default is no timeout."`
+	Results     string        `arg:"--results,help:file to write newline-delimited JSON results to, one object per command ('-' for stdout)."`
+	Stream      bool          `arg:"--stream,help:stream each command's stdout as it's produced instead of buffering it first. cannot be combined with -o/--ordered."`
+	Command     string        `arg:"positional,required,help:command to execute."`
+	log         *os.File      `arg:"-"`
+	stderrLog   *os.File      `arg:"-"`
+	results     io.Writer     `arg:"-"`
+}
+
+// stderrMode translates the --stderr flag into a process.StderrMode.
+func (p *Params) stderrMode() process.StderrMode {
+	switch p.Stderr {
+	case "", "inherit":
+		return process.StderrInherit
+	case "discard":
+		return process.StderrDiscard
+	case "capture":
+		return process.StderrCapture
+	case "merge":
+		return process.StderrMerge
+	default:
+		log.Fatalf("unknown --stderr mode: %s", p.Stderr)
+		return process.StderrInherit
+	}
 }
 
 // Version string for go-args
@@ -62,6 +90,9 @@ func main() {
 	if args.Sep != "" && args.Nlines > 1 {
 		p.Fail("must specify either sep (-s) or n-lines (-n), not both")
 	}
+	if args.Stream && args.Ordered {
+		p.Fail("--stream cannot be combined with -o/--ordered")
+	}
 	// if neither is specified then we default to whitespace
 	if args.Nlines == 1 && args.Sep == "" {
 		args.Sep = "\\s+"
@@ -75,6 +106,27 @@ func main() {
 		args.log, err = os.Create(args.Log)
 		check(err)
 	}
+	if args.stderrMode() == process.StderrCapture {
+		// Only create a stderr.log file when the user asked for one directly, or
+		// alongside an explicit --log; otherwise captured stderr goes to stdout, per
+		// --stderr-log's help text, instead of silently dropping a file in the cwd.
+		stderrLogPath := args.StderrLog
+		if stderrLogPath == "" && args.Log != "" {
+			stderrLogPath = filepath.Join(filepath.Dir(args.Log), "stderr.log")
+		}
+		if stderrLogPath != "" {
+			var err error
+			args.stderrLog, err = os.Create(stderrLogPath)
+			check(err)
+		}
+	}
+	if args.Results == "-" {
+		args.results = os.Stdout
+	} else if args.Results != "" {
+		f, err := os.Create(args.Results)
+		check(err)
+		args.results = f
+	}
 	runtime.GOMAXPROCS(args.Procs)
 	run(args)
 	os.Exit(ExitCode)
@@ -203,30 +255,111 @@ func run(args Params) {
 	tmpl := makeCommandTmpl(args.Command)
 	cmds := genCommands(&args, tmpl)
 
-	stdout := bufio.NewWriter(os.Stdout)
+	// commandOut is where each command's own stdout (and, absent --stderr-log, its
+	// captured stderr) is forwarded. --results - already claims stdout for NDJSON, so
+	// command output is rerouted to stderr instead of interleaving raw bytes with JSON
+	// lines on the same fd, which would defeat the point of chaining gargs on --results -.
+	var commandOut io.Writer = os.Stdout
+	if args.Results == "-" {
+		commandOut = os.Stderr
+	}
+	stdout := bufio.NewWriter(commandOut)
 	defer stdout.Flush()
 
 	cancel := make(chan bool)
-	defer close(cancel)
+	var cancelOnce sync.Once
+	closeCancel := func() { cancelOnce.Do(func() { close(cancel) }) }
+	defer closeCancel()
 	fails := 0
 
+	opts := &process.Options{
+		Ordered:     args.Ordered,
+		Retries:     args.Retry,
+		StderrMode:  args.stderrMode(),
+		Timeout:     args.Timeout,
+		ResultSink:  args.results,
+		Stream:      args.Stream,
+		StopOnError: args.StopOnError,
+	}
+
+	// opts.Remotes is always empty here: no flag populates it, so the SSH pool (health
+	// checks, weighted scheduling, the Stats/SIGUSR1 reporting below) is library-only
+	// today and never exercised by this binary. See the NOTE on sshConfig in ssh.go.
+	if len(opts.Remotes) > 0 {
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				printStats(opts)
+			}
+		}()
+		defer printStats(opts)
+	}
+
 	// flush stdout every 2 seconds.
 	last := time.Now().Add(2 * time.Second)
-	for p := range process.Runner(cmds, args.Retry, cancel, nil, args.Ordered) {
+	for p := range process.Runner(cmds, cancel, opts) {
+		if args.Verbose {
+			if args.Stream {
+				// p.String() previews stdout and the exit code, both of which block
+				// until the command finishes - print just the command instead so
+				// verbose logging doesn't defeat streaming.
+				fmt.Fprintf(os.Stderr, "%s\n", p.CmdStr)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s\n", p)
+			}
+		}
+		// Stdout (and stderr) are copied before ExitCode is checked so a streamed
+		// command's output reaches the terminal as it's produced instead of only once
+		// ExitCode's wait for completion returns.
+		var stderrErr chan error
+		if p.Stderr != nil && args.Stream {
+			// A streamed command's stdout/stderr are live OS pipes rather than the
+			// pre-drained buffers the non-stream path produces, so draining them one
+			// after the other here could deadlock: a child that fills the stderr pipe
+			// while still writing stdout would block forever waiting for us to read
+			// stderr, which we wouldn't get to until stdout's io.Copy below returns.
+			// Draining both concurrently, as oneRun does internally for the non-stream
+			// path, avoids that.
+			stderrErr = make(chan error, 1)
+			go func() {
+				w := commandOut
+				if args.stderrLog != nil {
+					w = args.stderrLog
+				}
+				_, err := io.Copy(w, p.Stderr)
+				stderrErr <- err
+			}()
+		}
+
+		_, err := io.Copy(stdout, p)
+		check(err)
+
+		if stderrErr != nil {
+			check(<-stderrErr)
+		} else if p.Stderr != nil {
+			w := commandOut
+			if args.stderrLog != nil {
+				w = args.stderrLog
+			}
+			_, err := io.Copy(w, p.Stderr)
+			check(err)
+		}
+		if args.Stream {
+			stdout.Flush()
+		}
+
 		if ex := p.ExitCode(); ex != 0 {
 			c := color.New(color.BgRed).Add(color.Bold)
 			fmt.Fprintf(os.Stderr, "%s\n", c.SprintFunc()(fmt.Sprintf("ERROR with command: %s", p)))
 			ExitCode = max(ExitCode, ex)
 			fails++
 			if args.StopOnError {
+				// cancel in-flight siblings immediately instead of waiting for run() to return.
+				closeCancel()
 				break
 			}
 		}
-		if args.Verbose {
-			fmt.Fprintf(os.Stderr, "%s\n", p)
-		}
-		_, err := io.Copy(stdout, p)
-		check(err)
 
 		p.Cleanup()
 		if t := time.Now(); t.After(last) {
@@ -252,6 +385,16 @@ func run(args Params) {
 
 }
 
+// printStats reports per-host load and outcome counters to stderr. run() wires it up to
+// SIGUSR1 and to its own return only when opts.Remotes is non-empty, which no flag of
+// this binary sets.
+func printStats(opts *process.Options) {
+	for _, s := range opts.Stats() {
+		fmt.Fprintf(os.Stderr, "%s: up=%v active=%d succeeded=%d failed=%d avg=%s\n",
+			s.Host, s.Up, s.Active, s.Succeeded, s.Failed, s.AvgDuration)
+	}
+}
+
 func makeCommandTmpl(cmd string) *fasttemplate.Template {
 	v := strings.Replace(cmd, "{}", "{Line}", -1)
 	return fasttemplate.New(v, "{", "}")
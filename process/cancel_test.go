@@ -0,0 +1,52 @@
+package process
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRunnerCancelDoesNotPanic reproduces the --stop-on-error regression where a worker
+// that saw cancel fire kept spinning through the rest of the queued commands (each
+// iteration re-selecting the already-closed cancel case) and closed the shared stdout
+// channel again on top of the close already done once every worker exits, panicking with
+// "close of closed channel". Runner must instead stop pulling commands as soon as cancel
+// fires and let stdout close exactly once.
+func TestRunnerCancelDoesNotPanic(t *testing.T) {
+	cmds := make(chan string)
+	go func() {
+		defer close(cmds)
+		for i := 0; i < 50; i++ {
+			cmds <- "true"
+		}
+	}()
+
+	cancel := make(chan bool)
+	var cancelOnce sync.Once
+	opts := &Options{StopOnError: true}
+
+	n := 0
+	for c := range Runner(cmds, cancel, opts) {
+		c.Cleanup()
+		n++
+		if n == 1 {
+			cancelOnce.Do(func() { close(cancel) })
+		}
+	}
+}
+
+// TestTimeout verifies that a command exceeding Options.Timeout is killed and reported
+// distinctly via ErrTimeout/TimeoutExit instead of hanging or reporting UnknownExit.
+func TestTimeout(t *testing.T) {
+	opts := &Options{Timeout: 50 * time.Millisecond, KillGrace: 50 * time.Millisecond}
+	cancel := make(chan bool)
+	c := Run(`sleep 5`, cancel, opts)
+	defer c.Cleanup()
+
+	if c.Err != ErrTimeout {
+		t.Fatalf("Err = %v, want ErrTimeout", c.Err)
+	}
+	if ex := c.ExitCode(); ex != TimeoutExit {
+		t.Fatalf("ExitCode() = %d, want %d", ex, TimeoutExit)
+	}
+}
@@ -3,6 +3,9 @@ package process
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,11 +14,11 @@ import (
 	"runtime"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/brentp/easyssh"
+	"golang.org/x/crypto/ssh"
 )
 
 // BufferSize determines how much output will be read into memory before resorting to using a temporary file
@@ -28,6 +31,17 @@ var WaitingMultiplier = 4
 // UnknownExit is used when the return/exit-code of the command is not known.
 const UnknownExit = 1
 
+// TimeoutExit is reported by ExitCode for a command killed after exceeding Options.Timeout,
+// matching the convention used by coreutils' `timeout`.
+const TimeoutExit = 124
+
+// DefaultKillGrace is the grace period given to a command to exit after SIGTERM/Signal
+// before it is forcibly killed, when Options.KillGrace is unset.
+const DefaultKillGrace = 5 * time.Second
+
+// ErrTimeout is the error set on a Command that was killed for exceeding Options.Timeout.
+var ErrTimeout = errors.New("gargs: command timed out")
+
 // prefix for tmp files.
 var prefix = fmt.Sprintf("gargs.%d.", os.Getpid())
 
@@ -39,28 +53,83 @@ func getShell() string {
 	return shell
 }
 
+// StderrMode controls how a command's stderr is handled.
+type StderrMode int
+
+const (
+	// StderrInherit connects the child's stderr directly to this process's stderr. This is the default
+	// and matches the historical behavior of gargs.
+	StderrInherit StderrMode = iota
+	// StderrDiscard drops the child's stderr entirely.
+	StderrDiscard
+	// StderrCapture reads the child's stderr into Command.Stderr, separate from stdout.
+	StderrCapture
+	// StderrMerge combines the child's stderr into the same stream as stdout (like shell's 2>&1).
+	StderrMerge
+)
+
 // Command contains a buffered reader with the realized stdout of the process along with the exit code.
 type Command struct {
 	*bufio.Reader
+	// Stderr holds the captured stderr of the command when Options.StderrMode is StderrCapture.
+	// It is nil for any other StderrMode.
+	Stderr   *bufio.Reader
 	tmp      *os.File
+	etmp     *os.File
 	Err      error
 	CmdStr   string
 	Duration time.Duration
+	// StartedAt is when the command (including any retries) started running.
+	StartedAt time.Time
+	// Retries is how many times the command was retried after a non-zero exit.
+	Retries int
+	// Host is the remote host the command ran on, or "" for local commands.
+	Host string
+	// StdoutBytes and StdoutSha256 describe the full stdout stream, regardless of
+	// whether it was small enough to stay in memory or spilled to a tmpfile. Both are
+	// left at their zero values for a streamed Command (Options.Stream).
+	StdoutBytes  int64
+	StdoutSha256 string
+	// StderrBytes is the size of the captured stderr stream. It is 0 unless
+	// Options.StderrMode is StderrCapture.
+	StderrBytes int64
+	// done is non-nil for a Command returned by a streaming run (Options.Stream): it is
+	// closed once cmd.Wait() completes and Err has been set, so Reader/Stderr can be read
+	// live while ExitCode/error block only when the caller actually asks for the result.
+	done chan struct{}
+}
+
+// wait blocks until a streaming Command's background Wait() has set Err, and is a no-op
+// for a Command produced by the normal (non-streaming) path.
+func (c *Command) wait() {
+	if c.done != nil {
+		<-c.done
+	}
 }
 
 func (c *Command) error() string {
-	if c == nil || c.Err == nil {
+	if c == nil {
+		return ""
+	}
+	c.wait()
+	if c.Err == nil {
 		return ""
 	}
 	return c.Err.Error()
 }
 
-// Close the temp file associated with the command
+// Close the temp file(s) associated with the command
 func (c *Command) Close() error {
-	if c.tmp == nil {
-		return nil
+	var err error
+	if c.tmp != nil {
+		err = c.tmp.Close()
+	}
+	if c.etmp != nil {
+		if eerr := c.etmp.Close(); err == nil {
+			err = eerr
+		}
 	}
-	return c.tmp.Close()
+	return err
 }
 
 // String returns a representation of the command that includes run-time, error (if any) and the first 20 chars of stdout.
@@ -88,11 +157,16 @@ func (c *Command) String() string {
 		cmd, prompt, exString, errString, c.Duration)
 }
 
-// ExitCode returns the exit code associated with a given error
+// ExitCode returns the exit code associated with a given error. For a streaming Command
+// (Options.Stream) this blocks until the command has actually finished.
 func (c *Command) ExitCode() int {
+	c.wait()
 	if c.Err == nil {
 		return 0
 	}
+	if c.Err == ErrTimeout {
+		return TimeoutExit
+	}
 	if ex, ok := c.Err.(*exec.ExitError); ok {
 		if st, ok := ex.Sys().(syscall.WaitStatus); ok {
 			return st.ExitStatus()
@@ -101,27 +175,82 @@ func (c *Command) ExitCode() int {
 	return UnknownExit
 }
 
-// Cleanup makes sure the tempfile is closed an deleted.
+// Cleanup makes sure the tempfile(s) are closed and deleted.
 func (c *Command) Cleanup() {
-	if c.tmp != nil {
-		c.Close()
+	if c.tmp != nil || c.etmp != nil {
 		cleanup(c)
 	}
 }
 
 func cleanup(c *Command) {
-	c.tmp.Close()
-	os.Remove(c.tmp.Name())
+	if c.tmp != nil {
+		c.tmp.Close()
+		os.Remove(c.tmp.Name())
+	}
+	if c.etmp != nil {
+		c.etmp.Close()
+		os.Remove(c.etmp.Name())
+	}
 }
 
 func newCommand(rdr *bufio.Reader, tmp *os.File, cmd string, err error) *Command {
-	c := &Command{rdr, tmp, err, cmd, 0}
-	if tmp != nil {
+	return newCommandWithStderr(rdr, tmp, 0, "", nil, nil, 0, cmd, err)
+}
+
+func newCommandWithStderr(rdr *bufio.Reader, tmp *os.File, stdoutBytes int64, stdoutSha256 string, erdr *bufio.Reader, etmp *os.File, stderrBytes int64, cmd string, err error) *Command {
+	c := &Command{
+		Reader:       rdr,
+		Stderr:       erdr,
+		tmp:          tmp,
+		etmp:         etmp,
+		Err:          err,
+		CmdStr:       cmd,
+		StdoutBytes:  stdoutBytes,
+		StdoutSha256: stdoutSha256,
+		StderrBytes:  stderrBytes,
+	}
+	if tmp != nil || etmp != nil {
 		runtime.SetFinalizer(c, cleanup)
 	}
 	return c
 }
 
+// newStreamCommand returns a *Command immediately after Start, wrapping the live stdout
+// (and, if captured, stderr) pipes instead of reading them fully first like spill does.
+// A background goroutine finishes cmd.Wait(), applies the same timeout/cancel handling
+// as the non-streaming path, and closes done so ExitCode/error can block on the real
+// result once the caller asks for it. StdoutBytes/StdoutSha256/StderrBytes are left at
+// their zero values, since nothing buffers the streams to compute them.
+func newStreamCommand(cmd cmdr, opipe io.Reader, epipe io.ReadCloser, command string, watchDone chan struct{}, timedOut chan error) *Command {
+	c := &Command{
+		Reader: bufio.NewReader(opipe),
+		CmdStr: command,
+		done:   make(chan struct{}),
+	}
+	if epipe != nil {
+		c.Stderr = bufio.NewReader(epipe)
+	}
+	go func() {
+		err := cmd.Wait()
+		if watchDone != nil {
+			close(watchDone)
+			select {
+			case terr := <-timedOut:
+				if terr != nil {
+					err = terr
+				}
+			default:
+			}
+		}
+		if s, ok := cmd.(*easyssh.Session); ok {
+			s.Close()
+		}
+		c.Err = err
+		close(c.done)
+	}()
+	return c
+}
+
 // CallBack is an optional function the user can provide to process the
 // stdout stream of the called Command. The user is responsible for closing
 // the io.Writer
@@ -129,50 +258,195 @@ type CallBack func(io.Reader, io.WriteCloser) error
 
 // Run takes a command string, executes the command,
 // Blocks until the output is finished and returns a *Command
-// that is an io.Reader. See Options for additional details.
-func Run(command string, opts *Options, env ...string) *Command {
+// that is an io.Reader; with Options.Stream it returns as soon as the command has
+// started. cancel is consulted only when opts sets Timeout or StopOnError, so that a
+// single command can be killed (e.g. --stop-on-error cancelling its in-flight siblings)
+// without tearing down the whole Runner. See Options for additional details.
+func Run(command string, cancel <-chan bool, opts *Options, env ...string) *Command {
 	t := time.Now()
 	var c *Command
 	var retries int
 	var host *sshConfig
+	var killGrace time.Duration
+	var stream bool
+	var stopOnError bool
 	if opts == nil {
-		c = oneRun(command, nil, env, nil)
+		c = oneRun(command, nil, env, nil, StderrInherit, cancel, 0, 0, false, false)
 	} else {
+		stream = opts.Stream
+		stopOnError = opts.StopOnError
 		host = opts.getHost()
 		if host != nil {
 			host.increment()
-			defer host.decrement()
+			if !stream {
+				defer host.decrement()
+			}
+		}
+		killGrace = opts.KillGrace
+		if killGrace == 0 {
+			killGrace = DefaultKillGrace
 		}
-		c = oneRun(command, opts.CallBack, env, host)
+		c = oneRun(command, opts.CallBack, env, host, opts.StderrMode, cancel, opts.Timeout, killGrace, stream, stopOnError)
 		retries = opts.Retries
 	}
-	for retries > 0 && c.ExitCode() != 0 {
+	// A streaming Command's ExitCode() blocks until the command finishes, so retrying it
+	// here would hold up every caller waiting on the first attempt until it completes -
+	// exactly what Stream exists to avoid. Retries are therefore not honored in Stream
+	// mode at all: the first attempt is handed back live, and whether it ultimately
+	// succeeded is left to whoever reads it.
+	triesUsed := 0
+	for !stream && retries > 0 && c.ExitCode() != 0 {
 		retries--
-		c = oneRun(command, opts.CallBack, env, host)
+		triesUsed++
+		c = oneRun(command, opts.CallBack, env, host, opts.StderrMode, cancel, opts.Timeout, killGrace, stream, stopOnError)
+	}
+	if stream {
+		// The command may still be running: finish bookkeeping once it actually
+		// completes rather than blocking here, which is exactly what Stream is for.
+		go func() {
+			c.wait()
+			c.Duration = time.Since(t)
+			c.StartedAt = t
+			c.Retries = triesUsed
+			if host != nil {
+				c.Host = host.Server
+				host.record(c.Duration, c.ExitCode() == 0)
+				host.decrement()
+			}
+			if opts.ResultSink != nil {
+				opts.writeResult(c)
+			}
+		}()
+		return c
 	}
 	c.Duration = time.Since(t)
+	c.StartedAt = t
+	c.Retries = triesUsed
+	if host != nil {
+		c.Host = host.Server
+		host.record(c.Duration, c.ExitCode() == 0)
+	}
+	if opts != nil && opts.ResultSink != nil {
+		opts.writeResult(c)
+	}
 	return c
 }
 
 // oRun calls run and sends result to channel. used when we want
 // to keep output in same order as input
-func oRun(command istring, opts *Options, env ...string) {
-	cmd := Run(command.string, opts, env...)
+func oRun(command istring, cancel <-chan bool, opts *Options, env ...string) {
+	cmd := Run(command.string, cancel, opts, env...)
 	command.ch <- cmd
 	close(command.ch)
 }
 
 type cmdr interface {
 	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
 	Start() error
 	Wait() error
 }
 
-func oneRun(command string, callback CallBack, env []string, cfg *sshConfig) *Command {
+// spill reads r fully, returning a reader backed by memory if the output fits within
+// BufferSize, or a temp file if it doesn't. It is used for both stdout and stderr so
+// the two streams spill to disk under the same rules. Alongside the reader it reports
+// the total byte count and sha256 of what was read, for Options.ResultSink.
+func spill(r io.Reader) (*bufio.Reader, *os.File, int64, string, error) {
+	bpipe := bufio.NewReaderSize(r, BufferSize)
+
+	res, err := bpipe.Peek(BufferSize)
+	// less than BufferSize bytes in output...
+	if err == bufio.ErrBufferFull || err == io.EOF {
+		sum := sha256.Sum256(res)
+		return bufio.NewReader(bytes.NewReader(res)), nil, int64(len(res)), hex.EncodeToString(sum[:]), nil
+	}
+	if err != nil {
+		return nil, nil, 0, "", err
+	}
+
+	// more than BufferSize bytes in output. must use tmpfile
+	tmp, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return bufio.NewReader(bytes.NewReader(res)), nil, 0, "", err
+	}
+	h := sha256.New()
+	btmp := bufio.NewWriter(tmp)
+	n, err := io.CopyBuffer(io.MultiWriter(btmp, h), bpipe, res)
+	if err != nil {
+		return bufio.NewReader(bytes.NewReader(res)), tmp, 0, "", err
+	}
+	if c, ok := r.(io.ReadCloser); ok {
+		c.Close()
+	}
+	btmp.Flush()
+	if _, err = tmp.Seek(0, 0); err != nil {
+		return nil, tmp, 0, "", err
+	}
+	return bufio.NewReader(tmp), tmp, n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// watchTimeout waits for cmd to finish (signalled by done being closed), or for timeout
+// to elapse, or for cancel to fire - whichever comes first. In the latter two cases it
+// kills cmd, giving it killGrace to exit before escalating. If it fires because of
+// timeout, ErrTimeout is sent on result so oneRun can report it distinctly.
+func watchTimeout(cmd cmdr, cancel <-chan bool, timeout, killGrace time.Duration, done chan struct{}, result chan<- error) {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-done:
+		return
+	case <-cancel:
+		killCommand(cmd, killGrace)
+	case <-timeoutCh:
+		result <- ErrTimeout
+		killCommand(cmd, killGrace)
+	}
+}
+
+// killCommand asks cmd to terminate (SIGTERM to the whole process group locally, or a
+// Signal request over the ssh session) and escalates to a hard kill after killGrace if
+// it's still running.
+func killCommand(cmd cmdr, killGrace time.Duration) {
+	switch c := cmd.(type) {
+	case *exec.Cmd:
+		if c.Process == nil {
+			return
+		}
+		pgid := c.Process.Pid
+		syscall.Kill(-pgid, syscall.SIGTERM)
+		if killGrace <= 0 {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			return
+		}
+		time.AfterFunc(killGrace, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+	case *easyssh.Session:
+		c.Signal(ssh.SIGTERM)
+		if killGrace <= 0 {
+			c.Close()
+			return
+		}
+		time.AfterFunc(killGrace, func() {
+			c.Close()
+		})
+	}
+}
+
+func oneRun(command string, callback CallBack, env []string, cfg *sshConfig, stderrMode StderrMode, cancel <-chan bool, timeout, killGrace time.Duration, stream, stopOnError bool) *Command {
 	var cmd cmdr
 
 	if cfg != nil {
 		var err error
+		if stderrMode == StderrMerge {
+			// ssh multiplexes stdout/stderr as separate channels, so merging is done
+			// by asking the remote shell to do it.
+			command += " 2>&1"
+		}
 		cmd, err = cfg.Command(command)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error connecting to %s@%s. Using local.\n", cfg.User, cfg.Server)
@@ -185,16 +459,58 @@ func oneRun(command string, callback CallBack, env []string, cfg *sshConfig) *Co
 		if c, ok := cmd.(*exec.Cmd); ok {
 			c.Env = os.Environ()
 			c.Env = append(c.Env, env...)
+		}
+	}
+	// The child is only put in its own process group - and thus only loses the terminal's
+	// Ctrl-C forwarding - when something might actually need to kill it mid-flight: a
+	// timeout, or --stop-on-error cancelling it as a sibling of a failed command. The
+	// cancel channel itself is always non-nil from the CLI (it also signals ordinary
+	// shutdown once every command has finished), so it can't be used for this check.
+	killable := timeout > 0 || stopOnError
+	if c, ok := cmd.(*exec.Cmd); ok {
+		switch stderrMode {
+		case StderrDiscard:
+			c.Stderr = nil
+		case StderrInherit:
 			c.Stderr = os.Stderr
 		}
+		// StderrMerge and StderrCapture are wired up below, once stdout (and, for
+		// capture, stderr) pipes exist.
+		if killable {
+			c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		}
 	}
+
 	var opipe io.Reader
 
 	spipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return newCommand(nil, nil, command, err)
 	}
-	defer spipe.Close()
+	if !stream {
+		// In stream mode the caller reads spipe (via opipe) after oneRun returns, so it
+		// must stay open; the Wait() goroutine started below closes it once the command
+		// exits, per the StdoutPipe doc.
+		defer spipe.Close()
+	}
+
+	if stderrMode == StderrMerge {
+		if c, ok := cmd.(*exec.Cmd); ok {
+			c.Stderr = c.Stdout
+		}
+	}
+
+	var epipe io.ReadCloser
+	if stderrMode == StderrCapture {
+		epipe, err = cmd.StderrPipe()
+		if err != nil {
+			return newCommand(nil, nil, command, err)
+		}
+		if !stream {
+			defer epipe.Close()
+		}
+	}
+
 	var errch chan error
 	if callback != nil {
 		errch = make(chan error, 1)
@@ -212,52 +528,65 @@ func oneRun(command string, callback CallBack, env []string, cfg *sshConfig) *Co
 	} else {
 		opipe = spipe
 	}
-	if err != nil {
-		return newCommand(nil, nil, command, err)
-	}
 
 	err = cmd.Start()
 	if err != nil {
 		return newCommand(nil, nil, command, err)
 	}
 
-	bpipe := bufio.NewReaderSize(opipe, BufferSize)
-
-	var res []byte
-	res, err = bpipe.Peek(BufferSize)
+	// watchTimeout races the timeout/cancel against the command finishing on its own,
+	// killing it (process-group SIGTERM, then SIGKILL after killGrace) if it loses.
+	var watchDone chan struct{}
+	var timedOut chan error
+	if killable {
+		watchDone = make(chan struct{})
+		timedOut = make(chan error, 1)
+		go watchTimeout(cmd, cancel, timeout, killGrace, watchDone, timedOut)
+	}
 
-	// less than BufferSize bytes in output...
-	if err == bufio.ErrBufferFull || err == io.EOF {
-		err = cmd.Wait()
-		if err == nil && callback != nil {
-			if e, ok := <-errch; ok {
-				err = e
-			}
-		}
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), nil, command, err)
+	if stream {
+		return newStreamCommand(cmd, opipe, epipe, command, watchDone, timedOut)
 	}
-	if err != nil {
-		return newCommand(nil, nil, command, err)
+
+	// stderr is drained concurrently with stdout below so that a child that fills
+	// both OS pipe buffers can't deadlock waiting on the one we haven't read yet.
+	var stderrDone chan struct{}
+	var erdr *bufio.Reader
+	var etmp *os.File
+	var stderrBytes int64
+	var stderrErr error
+	if epipe != nil {
+		stderrDone = make(chan struct{})
+		go func() {
+			defer close(stderrDone)
+			erdr, etmp, stderrBytes, _, stderrErr = spill(epipe)
+		}()
 	}
 
-	// more than BufferSize bytes in output. must use tmpfile
-	var tmp *os.File
-	tmp, err = ioutil.TempFile("", prefix)
-	if err != nil {
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), tmp, command, err)
+	rdr, tmp, stdoutBytes, stdoutSha256, err := spill(opipe)
+	if stderrDone != nil {
+		<-stderrDone
+		if err == nil {
+			err = stderrErr
+		}
 	}
-	btmp := bufio.NewWriter(tmp)
-	_, err = io.CopyBuffer(btmp, bpipe, res)
 	if err != nil {
-		return newCommand(bufio.NewReader(bytes.NewReader(res)), tmp, command, err)
-	}
-	if c, ok := opipe.(io.ReadCloser); ok {
-		c.Close()
+		if watchDone != nil {
+			close(watchDone)
+		}
+		return newCommandWithStderr(rdr, tmp, stdoutBytes, stdoutSha256, erdr, etmp, stderrBytes, command, err)
 	}
-	btmp.Flush()
-	_, err = tmp.Seek(0, 0)
-	if err == nil {
-		err = cmd.Wait()
+
+	err = cmd.Wait()
+	if watchDone != nil {
+		close(watchDone)
+		select {
+		case terr := <-timedOut:
+			if terr != nil {
+				err = terr
+			}
+		default:
+		}
 	}
 	if c, ok := cmd.(*easyssh.Session); ok {
 		c.Close()
@@ -267,7 +596,7 @@ func oneRun(command string, callback CallBack, env []string, cfg *sshConfig) *Co
 			err = e
 		}
 	}
-	return newCommand(bufio.NewReader(tmp), tmp, command, err)
+	return newCommandWithStderr(rdr, tmp, stdoutBytes, stdoutSha256, erdr, etmp, stderrBytes, command, err)
 }
 
 // istring holds a command and an index.
@@ -313,52 +642,77 @@ type Options struct {
 	// Retries indicates the number of times a process will be retried if it has
 	// a non-zero exit code.
 	Retries int
-
-	// Remotes is an optional slice of remote workers connected via ssh.
+	// StderrMode controls how each command's stderr is handled. The default
+	// (StderrInherit) matches the historical behavior of gargs.
+	StderrMode StderrMode
+	// Timeout, if non-zero, kills a command that runs longer than this.
+	Timeout time.Duration
+	// KillGrace is how long a timed-out or cancelled command is given to exit after
+	// SIGTERM/Signal before it is sent SIGKILL. Defaults to DefaultKillGrace when zero.
+	KillGrace time.Duration
+	// StopOnError indicates that in-flight siblings will be killed via the cancel
+	// channel as soon as one command fails (the CLI's --stop-on-error). Along with
+	// Timeout, it decides whether a local command is put in its own process group: the
+	// cancel channel passed to Run/Runner is otherwise always non-nil (it also signals
+	// ordinary shutdown once every command has finished), so it can't be used by itself
+	// to tell whether a command might actually need killing mid-flight.
+	StopOnError bool
+	// ResultSink, if set, receives one JSON-encoded Result per completed command. Safe
+	// for concurrent commands to share: writes are serialized with resultMu.
+	ResultSink io.Writer
+	resultMu   sync.Mutex
+
+	// Remotes is an optional pool of remote workers connected via ssh.
 	Remotes []*sshConfig
+	// HealthCheckInterval controls how often Remotes are re-probed. Defaults to
+	// DefaultHealthCheckInterval when zero.
+	HealthCheckInterval time.Duration
+	healthOnce          sync.Once
+
+	// Stream, if set, skips the BufferSize peek/tmpfile spill and hands back each
+	// Command's Reader/Stderr wrapping the live pipe instead, so output like `tail -f`
+	// can be copied out as it's produced rather than only once the command exits (or
+	// BufferSize is exceeded). ExitCode and the error behind a streamed Command block
+	// until it actually finishes. Stream is incompatible with Ordered: Runner panics if
+	// both are set, since ordering requires knowing a command is done before starting
+	// the next one, which defeats the point of streaming.
+	Stream bool
 }
 
-func (o Options) perHost() int {
-	n := len(o.Remotes) + 1
-	return runtime.GOMAXPROCS(0) / n
-}
-
-// choose which host to run on. if the remote hosts are busy
-// then we use the localhost.
-func (o Options) getHost() *sshConfig {
+// choose which host to run on: the healthy remote with the most spare capacity
+// relative to its Weight, or nil (meaning run locally) if every remote is down or
+// already at its MaxJobs.
+func (o *Options) getHost() *sshConfig {
 	if len(o.Remotes) == 0 {
 		return nil
 	}
-	ph := int32(o.perHost())
+	o.startHealthChecks()
+	var best *sshConfig
+	var bestLoad float64
 	for _, r := range o.Remotes {
-		if *(r.counter) < ph {
-			return r
+		if !r.isUp() {
+			continue
+		}
+		active := r.count()
+		if int(active) >= r.maxJobs(runtime.GOMAXPROCS(0), len(o.Remotes)) {
+			continue
+		}
+		load := float64(active) / float64(r.Weight)
+		if best == nil || load < bestLoad {
+			best = r
+			bestLoad = load
 		}
 	}
-	return nil
-}
-
-type sshConfig struct {
-	*easyssh.Config
-	counter *int32
-}
-
-func (s *sshConfig) increment() {
-	atomic.AddInt32(s.counter, 1)
-}
-
-func (s *sshConfig) decrement() {
-	atomic.AddInt32(s.counter, -1)
-}
-
-func (s *sshConfig) count() int32 {
-	return *(s.counter)
+	return best
 }
 
 // Runner accepts commands from a channel and sends a bufio.Reader on the returned channel.
 // done allows the caller to stop Runner, for example if an error occurs.
 // It will parallelize according to GOMAXPROCS. See Options for more details.
 func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Command {
+	if opts.Stream && opts.Ordered {
+		panic("process: Options.Stream cannot be combined with Options.Ordered; ordering requires each command to finish before the next is sent, which Stream is meant to avoid")
+	}
 	if opts.Ordered {
 		return oRunner(commands, cancel, opts)
 	}
@@ -366,6 +720,12 @@ func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Com
 	stdout := make(chan *Command, runtime.GOMAXPROCS(0))
 	icommands := enumerate(commands, nil)
 
+	// stdout must be closed exactly once. A worker that sees cancel fire just stops
+	// pulling commands and returns; the closing itself is left to the wg.Wait goroutine
+	// below, which runs once every worker (cancelled or not) has exited.
+	var closeStdoutOnce sync.Once
+	closeStdout := func() { closeStdoutOnce.Do(func() { close(stdout) }) }
+
 	wg := &sync.WaitGroup{}
 	wg.Add(runtime.GOMAXPROCS(0))
 
@@ -376,13 +736,12 @@ func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Com
 			// workers read off the same channel of incoming commands.
 			for cmd := range icommands {
 				select {
-				case stdout <- Run(cmd.string, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i)):
+				case stdout <- Run(cmd.string, cancel, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i)):
 				case <-cancel:
-					// if we receive from this, we must exit.
-					// receive from closed channel will continually yield false
-					// so it does what we expect.
-					close(stdout)
-					break
+					// receive from a closed channel continually yields ready, so without
+					// returning here the worker would spin through every remaining
+					// queued command instead of stopping.
+					return
 				}
 
 			}
@@ -391,7 +750,7 @@ func Runner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Com
 
 	go func() {
 		wg.Wait()
-		close(stdout)
+		closeStdout()
 	}()
 
 	return stdout
@@ -415,7 +774,7 @@ func oRunner(commands <-chan string, cancel <-chan bool, opts *Options) chan *Co
 		go func() {
 			// workers read off the same channel of incoming commands.
 			for cmd := range icommands {
-				oRun(cmd, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i))
+				oRun(cmd, cancel, opts, fmt.Sprintf("PROCESS_I=%d", cmd.i))
 			}
 		}()
 	}
@@ -0,0 +1,61 @@
+package process
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// TestStderrCapture verifies that a command's stderr is captured separately from stdout
+// when Options.StderrMode is StderrCapture, rather than being dropped or merged.
+func TestStderrCapture(t *testing.T) {
+	opts := &Options{StderrMode: StderrCapture}
+	cancel := make(chan bool)
+	c := Run(`echo out; echo err 1>&2`, cancel, opts)
+	defer c.Cleanup()
+
+	out, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("reading stdout: %v", err)
+	}
+	if string(out) != "out\n" {
+		t.Errorf("stdout = %q, want %q", out, "out\n")
+	}
+
+	if c.Stderr == nil {
+		t.Fatal("Stderr reader is nil, want captured stderr")
+	}
+	errOut, err := ioutil.ReadAll(c.Stderr)
+	if err != nil {
+		t.Fatalf("reading stderr: %v", err)
+	}
+	if string(errOut) != "err\n" {
+		t.Errorf("stderr = %q, want %q", errOut, "err\n")
+	}
+}
+
+// TestStderrSpillsToTmpFile verifies that stderr larger than BufferSize is spilled to a
+// temp file, just like stdout does, instead of staying in memory.
+func TestStderrSpillsToTmpFile(t *testing.T) {
+	old := BufferSize
+	BufferSize = 16
+	defer func() { BufferSize = old }()
+
+	opts := &Options{StderrMode: StderrCapture}
+	cancel := make(chan bool)
+	c := Run(`i=0; while [ $i -lt 100 ]; do printf e; i=$((i+1)); done 1>&2`, cancel, opts)
+	defer c.Cleanup()
+
+	if c.etmp == nil {
+		t.Fatal("expected stderr to spill to a temp file, etmp is nil")
+	}
+	errOut, err := ioutil.ReadAll(c.Stderr)
+	if err != nil {
+		t.Fatalf("reading spilled stderr: %v", err)
+	}
+	if len(errOut) != 100 {
+		t.Errorf("spilled stderr length = %d, want 100", len(errOut))
+	}
+	if c.StderrBytes != 100 {
+		t.Errorf("StderrBytes = %d, want 100", c.StderrBytes)
+	}
+}
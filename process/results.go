@@ -0,0 +1,68 @@
+package process
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Result is the structured, machine-readable summary of a single finished Command. One
+// Result is written as a JSON object to Options.ResultSink per completed command, so
+// tools can chain gargs invocations without scraping the human-readable --log format.
+type Result struct {
+	CmdStr       string    `json:"cmdstr"`
+	ExitCode     int       `json:"exit_code"`
+	Error        string    `json:"error,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+	Retries      int       `json:"retries"`
+	Host         string    `json:"host,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	StdoutBytes  int64     `json:"stdout_bytes"`
+	StderrBytes  int64     `json:"stderr_bytes"`
+	StdoutSha256 string    `json:"stdout_sha256,omitempty"`
+}
+
+// result summarizes c as a Result.
+func (c *Command) result() Result {
+	return Result{
+		CmdStr:       c.CmdStr,
+		ExitCode:     c.ExitCode(),
+		Error:        c.error(),
+		DurationMs:   c.Duration.Nanoseconds() / int64(time.Millisecond),
+		Retries:      c.Retries,
+		Host:         c.Host,
+		StartedAt:    c.StartedAt,
+		StdoutBytes:  c.StdoutBytes,
+		StderrBytes:  c.StderrBytes,
+		StdoutSha256: c.StdoutSha256,
+	}
+}
+
+// writeResult encodes c as a Result and writes it to o.ResultSink, serializing
+// concurrent writers so JSON lines from different commands never interleave.
+func (o *Options) writeResult(c *Command) {
+	o.resultMu.Lock()
+	defer o.resultMu.Unlock()
+	// Encode errors (e.g. a full disk) are deliberately ignored here, matching how a
+	// failure to write --log is otherwise handled: it shouldn't abort the run.
+	json.NewEncoder(o.ResultSink).Encode(c.result())
+}
+
+// DecodeResults streams the Results written to Options.ResultSink back as Go structs, so
+// another tool (or another gargs invocation) can consume them with `--results -`. It
+// closes the returned channel once r is exhausted or yields a malformed line.
+func DecodeResults(r io.Reader) <-chan Result {
+	ch := make(chan Result)
+	go func() {
+		defer close(ch)
+		dec := json.NewDecoder(r)
+		for dec.More() {
+			var res Result
+			if err := dec.Decode(&res); err != nil {
+				return
+			}
+			ch <- res
+		}
+	}()
+	return ch
+}
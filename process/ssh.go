@@ -0,0 +1,194 @@
+package process
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentp/easyssh"
+)
+
+// DefaultHealthCheckInterval is how often the hosts in Options.Remotes are re-probed when
+// Options.HealthCheckInterval is unset.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// healthCheckCommand is the cheap command used to decide whether a host is reachable.
+const healthCheckCommand = "true"
+
+// HostConfig describes one remote worker: its ssh connection details plus the
+// scheduling knobs a pool uses to balance load across hosts.
+type HostConfig struct {
+	*easyssh.Config
+	// MaxJobs caps how many commands may run on this host at once. Zero means "split
+	// GOMAXPROCS evenly across the pool plus the local machine" (at least 1), matching
+	// the historical fixed perHost count.
+	MaxJobs int
+	// Weight biases selection toward beefier hosts: a host is chosen by lowest
+	// active/Weight, so doubling Weight roughly doubles its share of the work. Zero is
+	// treated as 1.
+	Weight int
+}
+
+// sshConfig is one host inside Options.Remotes: its connection info, scheduling knobs,
+// and the live health/load state the pool uses to select and report on it.
+//
+// NOTE: the gargs binary has no flag that populates Options.Remotes (there never was
+// one), so this whole pool - health checks, weighted scheduling, and the Stats/SIGUSR1
+// reporting in main.go - is reachable only by callers of this package directly, not by
+// running gargs itself. Wiring up a --remote flag is left for a follow-up request.
+type sshConfig struct {
+	*HostConfig
+
+	mu   sync.Mutex
+	up   bool // cleared/set only by probe, read by getHost
+	seen bool // true once the first probe has completed
+
+	active    int32 // atomic: commands currently running on this host
+	succeeded int64 // atomic
+	failed    int64 // atomic
+	totalNS   int64 // atomic: sum of command durations, for Stats' average
+}
+
+// NewHost wraps connection details and scheduling knobs into a worker for
+// Options.Remotes. The host is assumed reachable until the first health check says
+// otherwise.
+func NewHost(cfg *HostConfig) *sshConfig {
+	if cfg.Weight <= 0 {
+		cfg.Weight = 1
+	}
+	return &sshConfig{HostConfig: cfg, up: true}
+}
+
+func (s *sshConfig) increment() {
+	atomic.AddInt32(&s.active, 1)
+}
+
+func (s *sshConfig) decrement() {
+	atomic.AddInt32(&s.active, -1)
+}
+
+func (s *sshConfig) count() int32 {
+	return atomic.LoadInt32(&s.active)
+}
+
+// record updates this host's counters once a command finishes on it.
+func (s *sshConfig) record(d time.Duration, ok bool) {
+	atomic.AddInt64(&s.totalNS, int64(d))
+	if ok {
+		atomic.AddInt64(&s.succeeded, 1)
+	} else {
+		atomic.AddInt64(&s.failed, 1)
+	}
+}
+
+// isUp reports whether the last health check found this host reachable. A host that
+// hasn't been probed yet is assumed up so a pool is usable before the first probe
+// completes.
+func (s *sshConfig) isUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.seen || s.up
+}
+
+// maxJobs returns this host's job cap, falling back to an even split of procs across
+// the pool (the historical behavior) when MaxJobs is unset.
+func (s *sshConfig) maxJobs(procs, poolSize int) int {
+	if s.MaxJobs > 0 {
+		return s.MaxJobs
+	}
+	if n := procs / (poolSize + 1); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// probe runs a cheap command on the host to decide whether it's up, reconnecting
+// through a fresh easyssh.Config dial since the prior connection may have dropped.
+func (s *sshConfig) probe() {
+	up := false
+	if cmd, err := s.Command(healthCheckCommand); err == nil {
+		if err := cmd.Start(); err == nil {
+			up = cmd.Wait() == nil
+		}
+		if sess, ok := cmd.(*easyssh.Session); ok {
+			sess.Close()
+		}
+	}
+	s.mu.Lock()
+	s.up = up
+	s.seen = true
+	s.mu.Unlock()
+}
+
+// Stats summarizes one host's load and outcome counters as of the call.
+type Stats struct {
+	Host        string
+	Up          bool
+	Active      int32
+	Succeeded   int64
+	Failed      int64
+	AvgDuration time.Duration
+}
+
+// Stats reports per-host counters for every remote in the pool, in the order the hosts
+// were added. The CLI prints this on SIGUSR1 or at exit.
+func (o *Options) Stats() []Stats {
+	stats := make([]Stats, len(o.Remotes))
+	for i, h := range o.Remotes {
+		succeeded := atomic.LoadInt64(&h.succeeded)
+		failed := atomic.LoadInt64(&h.failed)
+		var avg time.Duration
+		if n := succeeded + failed; n > 0 {
+			avg = time.Duration(atomic.LoadInt64(&h.totalNS) / n)
+		}
+		stats[i] = Stats{
+			Host:        h.Server,
+			Up:          h.isUp(),
+			Active:      h.count(),
+			Succeeded:   succeeded,
+			Failed:      failed,
+			AvgDuration: avg,
+		}
+	}
+	return stats
+}
+
+// Command dials the host and prepares cmdstr to run, returning the resulting
+// *easyssh.Session (which satisfies cmdr). Each call reconnects from scratch via the
+// embedded easyssh.Config, so a host that dropped its connection since the last health
+// check (or the last command) is retried rather than left for dead.
+func (s *sshConfig) Command(cmdstr string) (cmdr, error) {
+	session, err := s.HostConfig.Config.Command(cmdstr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s@%s: %w", s.User, s.Server, err)
+	}
+	return session, nil
+}
+
+// startHealthChecks probes every remote once immediately, then launches a background
+// loop that re-probes on Options.HealthCheckInterval. It runs at most once per Options,
+// even though getHost calls it for every command.
+func (o *Options) startHealthChecks() {
+	if len(o.Remotes) == 0 {
+		return
+	}
+	o.healthOnce.Do(func() {
+		interval := o.HealthCheckInterval
+		if interval <= 0 {
+			interval = DefaultHealthCheckInterval
+		}
+		for _, h := range o.Remotes {
+			go h.probe()
+		}
+		go func() {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for range t.C {
+				for _, h := range o.Remotes {
+					go h.probe()
+				}
+			}
+		}()
+	})
+}